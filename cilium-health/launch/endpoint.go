@@ -18,10 +18,10 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"os"
+	"net"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"runtime"
 	"time"
 
 	"github.com/cilium/cilium/api/v1/models"
@@ -34,6 +34,7 @@ import (
 	"github.com/cilium/cilium/pkg/health/defaults"
 	"github.com/cilium/cilium/pkg/k8s"
 	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/mtu"
 	"github.com/cilium/cilium/pkg/node"
@@ -41,6 +42,7 @@ import (
 	"github.com/cilium/cilium/pkg/pidfile"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 )
 
 var (
@@ -50,9 +52,25 @@ var (
 	// vethPeerName is the endpoint-side link device name for cilium-health.
 	vethPeerName = "cilium"
 
+	// healthContainerName names both the cilium-health endpoint and the
+	// network namespace LaunchAsEndpoint creates for it (netns.NewNamed
+	// uses this same string), so CleanupEndpoint must look it up by this
+	// name too rather than by vethName.
+	healthContainerName = "cilium-health"
+
 	// healthPidfile
 	healthPidfile = "health-endpoint.pid"
 
+	// healthAdminSocket is the name of the unix admin socket the
+	// cilium-health binary listens on inside its network namespace, used
+	// to detect that it has finished starting up.
+	healthAdminSocket = "health-admin.sock"
+
+	// clientMutex guards client, which is written by LaunchAsEndpoint on
+	// every (re)start and read by PingEndpoint, possibly concurrently once
+	// the Supervisor is restarting the endpoint in the background.
+	clientMutex lock.RWMutex
+
 	// client is used to ping the cilium-health endpoint as a health check.
 	client *healthPkg.Client
 )
@@ -83,8 +101,28 @@ func logFromCommand(cmd *exec.Cmd, netns string) error {
 	return nil
 }
 
-func configureHealthRouting(netns, dev string, addressing *models.NodeAddressing) error {
-	routes := []plugins.Route{}
+// configureHealthRouting enters the cilium-health network namespace on the
+// current OS thread and configures dev with the routes derived from
+// addressing, using netlink directly instead of shelling out to `ip netns
+// exec`. The caller must not unlock the OS thread until this returns.
+func configureHealthRouting(netNs netns.NsHandle, dev string, addressing *models.NodeAddressing) error {
+	origNs, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("unable to get current netns: %s", err)
+	}
+	defer origNs.Close()
+
+	if err := netns.Set(netNs); err != nil {
+		return fmt.Errorf("unable to enter cilium-health netns: %s", err)
+	}
+	defer netns.Set(origNs)
+
+	link, err := netlink.LinkByName(dev)
+	if err != nil {
+		return fmt.Errorf("unable to find %s inside cilium-health netns: %s", dev, err)
+	}
+
+	var routes []plugins.Route
 	v4Routes, err := plugins.IPv4Routes(addressing, mtu.StandardMTU)
 	if err == nil {
 		routes = append(routes, v4Routes...)
@@ -97,33 +135,34 @@ func configureHealthRouting(netns, dev string, addressing *models.NodeAddressing
 	}
 	routes = append(routes, v6Routes...)
 
-	prog := "ip"
-	args := []string{"netns", "exec", netns, "bash", "-c"}
-	routeCmds := []string{}
 	for _, rt := range routes {
-		cmd := strings.Join(rt.ToIPCommand(dev), " ")
-		log.WithField("netns", netns).WithField("command", cmd).Info("Adding route")
-		routeCmds = append(routeCmds, cmd)
-	}
-	cmd := strings.Join(routeCmds, " && ")
-	args = append(args, cmd)
-
-	log.Debugf("Running \"%s %+v\"", prog, args)
-	out, err := exec.Command(prog, args...).CombinedOutput()
-	if err == nil && len(out) > 0 {
-		log.Warn(out)
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &rt.Prefix,
+		}
+		if rt.Nexthop != nil {
+			route.Gw = *rt.Nexthop
+		}
+		log.WithField("netns", netNs.String()).WithField("route", route).Info("Adding route")
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("unable to add route %s: %s", route, err)
+		}
 	}
 
-	return err
+	return nil
 }
 
 // PingEndpoint attempts to make an API ping request to the local cilium-health
 // endpoint, and returns whether this was successful.
 func PingEndpoint() error {
-	if client == nil {
+	clientMutex.RLock()
+	c := client
+	clientMutex.RUnlock()
+
+	if c == nil {
 		return fmt.Errorf("cilium-health endpoint hasn't yet been initialized")
 	}
-	_, err := client.Restapi.GetHello(nil)
+	_, err := c.Restapi.GetHello(nil)
 	return err
 }
 
@@ -145,15 +184,71 @@ func CleanupEndpoint(owner endpoint.Owner) {
 	} else {
 		scopedLog.WithError(err).Debug("Didn't find existing device")
 	}
+
+	if ns, err := netns.GetFromName(healthContainerName); err == nil {
+		ns.Close()
+		if err := netns.DeleteNamed(healthContainerName); err != nil {
+			scopedLog.WithError(err).Info("Couldn't remove cilium-health netns")
+		}
+	}
+}
+
+// waitForAdminSocket polls sockPath until a connection succeeds or deadline
+// passes, used as a readiness handshake for the cilium-health process in
+// place of polling for the existence of its pidfile.
+func waitForAdminSocket(sockPath string, deadline time.Time) error {
+	var lastErr error
+	for {
+		conn, err := net.Dial("unix", sockPath)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		lastErr = err
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cilium-health endpoint did not become ready: %s", lastErr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// spawnInNetns starts the cilium-health binary with args, with the current
+// OS thread (and thus the forked child) inside netNs. The caller is
+// responsible for having called runtime.LockOSThread beforehand.
+func spawnInNetns(netNs netns.NsHandle, containerName string, args []string) (*exec.Cmd, error) {
+	origNs, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current netns: %s", err)
+	}
+	defer origNs.Close()
+
+	if err := netns.Set(netNs); err != nil {
+		return nil, fmt.Errorf("unable to enter cilium-health netns: %s", err)
+	}
+	defer netns.Set(origNs)
+
+	cmd := exec.CommandContext(context.Background(), "cilium-health", args...)
+	if err := logFromCommand(cmd, containerName); err != nil {
+		return nil, fmt.Errorf("Error while opening pipes to health endpoint: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		target := fmt.Sprintf("cilium-health %s", args)
+		return nil, fmt.Errorf("Error spawning endpoint (%q): %s", target, err)
+	}
+
+	return cmd, nil
 }
 
 // LaunchAsEndpoint launches the cilium-health agent in a nested network
 // namespace and attaches it to Cilium the same way as any other endpoint,
-// but with special reserved labels.
+// but with special reserved labels. The returned *exec.Cmd is the caller's
+// to own (e.g. a Supervisor waiting on it and killing it on restart);
+// LaunchAsEndpoint keeps no reference to it once it returns.
 //
 // CleanupEndpoint() must be called before calling LaunchAsEndpoint() to ensure
 // cleanup of prior cilium-health endpoint instances.
-func LaunchAsEndpoint(owner endpoint.Owner, hostAddressing *models.NodeAddressing) error {
+func LaunchAsEndpoint(owner endpoint.Owner, hostAddressing *models.NodeAddressing) (*exec.Cmd, error) {
 
 	ip4 := node.GetIPv4HealthIP()
 	ip6 := node.GetIPv6HealthIP()
@@ -163,7 +258,7 @@ func LaunchAsEndpoint(owner endpoint.Owner, hostAddressing *models.NodeAddressin
 	info := &models.EndpointChangeRequest{
 		ID:            id,
 		ContainerID:   endpointid.NewCiliumID(id),
-		ContainerName: "cilium-health",
+		ContainerName: healthContainerName,
 		State:         models.EndpointStateWaitingForIdentity,
 		Addressing: &models.AddressPair{
 			IPV6: ip6.String(),
@@ -172,28 +267,87 @@ func LaunchAsEndpoint(owner endpoint.Owner, hostAddressing *models.NodeAddressin
 	}
 
 	if _, _, err := plugins.SetupVethWithNames(vethName, vethPeerName, mtu.StandardMTU, info); err != nil {
-		return fmt.Errorf("Error while creating veth: %s", err)
+		return nil, fmt.Errorf("Error while creating veth: %s", err)
 	}
 
-	pidfile := filepath.Join(option.Config.StateDir, healthPidfile)
-	healthArgs := fmt.Sprintf("-d --admin=unix --passive --pidfile %s", pidfile)
-	args := []string{info.ContainerName, info.InterfaceName, vethPeerName,
-		ip6.String(), ip4.String(), "cilium-health", healthArgs}
-	prog := filepath.Join(owner.GetBpfDir(), "spawn_netns.sh")
+	// Move the peer end of the veth into a new network namespace and
+	// bring it up with its addresses before starting cilium-health
+	// inside it. The whole sequence has to run on a single, locked OS
+	// thread: entering and leaving a network namespace is a per-thread
+	// operation.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 
-	cmd := exec.CommandContext(context.Background(), prog, args...)
-	if err := logFromCommand(cmd, info.ContainerName); err != nil {
-		return fmt.Errorf("Error while opening pipes to health endpoint: %s", err)
+	origNs, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current netns: %s", err)
 	}
-	if err := cmd.Start(); err != nil {
-		target := fmt.Sprintf("%s %s", prog, strings.Join(args, " "))
-		return fmt.Errorf("Error spawning endpoint (%q): %s", target, err)
+	defer origNs.Close()
+
+	healthNs, err := netns.NewNamed(info.ContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("Error while creating health netns: %s", err)
+	}
+	defer healthNs.Close()
+	// netns.NewNamed both creates the namespace and switches the current
+	// thread into it; switch back so the rest of this function observes
+	// the host namespace unless explicitly entering healthNs.
+	if err := netns.Set(origNs); err != nil {
+		return nil, fmt.Errorf("unable to restore host netns: %s", err)
+	}
+
+	peerLink, err := netlink.LinkByName(vethPeerName)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding %s: %s", vethPeerName, err)
+	}
+	if err := netlink.LinkSetNsFd(peerLink, int(healthNs)); err != nil {
+		return nil, fmt.Errorf("Error moving %s into health netns: %s", vethPeerName, err)
+	}
+
+	if err := func() error {
+		if err := netns.Set(healthNs); err != nil {
+			return fmt.Errorf("unable to enter cilium-health netns: %s", err)
+		}
+		defer netns.Set(origNs)
+
+		link, err := netlink.LinkByName(vethPeerName)
+		if err != nil {
+			return fmt.Errorf("Error finding %s inside health netns: %s", vethPeerName, err)
+		}
+		if addr, err := netlink.ParseAddr(ip4.String() + "/32"); err == nil {
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return fmt.Errorf("Error adding %s to %s: %s", ip4, vethPeerName, err)
+			}
+		}
+		if addr, err := netlink.ParseAddr(ip6.String() + "/128"); err == nil {
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return fmt.Errorf("Error adding %s to %s: %s", ip6, vethPeerName, err)
+			}
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("Error bringing up %s: %s", vethPeerName, err)
+		}
+		return nil
+	}(); err != nil {
+		return nil, err
+	}
+
+	pidfilePath := filepath.Join(option.Config.StateDir, healthPidfile)
+	adminSocket := filepath.Join(option.Config.StateDir, healthAdminSocket)
+	args := []string{
+		info.InterfaceName, vethPeerName, ip6.String(), ip4.String(),
+		"-d", "--admin=unix", "--passive", "--pidfile", pidfilePath, "--socket", adminSocket,
+	}
+
+	cmd, err := spawnInNetns(healthNs, info.ContainerName, args)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the endpoint
 	ep, err := endpoint.NewEndpointFromChangeModel(info)
 	if err != nil {
-		return fmt.Errorf("Error while creating endpoint model: %s", err)
+		return nil, fmt.Errorf("Error while creating endpoint model: %s", err)
 	}
 	ep.SetDefaultOpts(option.Config.Opts)
 
@@ -201,41 +355,45 @@ func LaunchAsEndpoint(owner endpoint.Owner, hostAddressing *models.NodeAddressin
 	lbls := labels.Labels{labels.IDNameHealth: labels.NewLabel(labels.IDNameHealth, "", labels.LabelSourceReserved)}
 	ep.SetIdentityLabels(owner, lbls)
 
-	// Wait until the cilium-health endpoint is running before setting up routes
+	// Wait until the cilium-health endpoint is accepting connections on
+	// its admin socket before setting up routes.
 	deadline := time.Now().Add(5 * time.Second)
-	for {
-		if _, err := os.Stat(pidfile); err == nil {
-			log.WithField("pidfile", pidfile).Debug("cilium-health agent running")
-			break
-		} else if time.Now().After(deadline) {
-			return fmt.Errorf("Endpoint failed to run: %s", err)
-		} else {
-			time.Sleep(100 * time.Millisecond)
-		}
+	if err := waitForAdminSocket(adminSocket, deadline); err != nil {
+		return nil, err
 	}
+	log.WithField("pidfile", pidfilePath).Debug("cilium-health agent running")
 
 	// Set up the endpoint routes
-	if err = configureHealthRouting(info.ContainerName, vethPeerName, hostAddressing); err != nil {
-		return fmt.Errorf("Error while configuring routes: %s", err)
+	if err = configureHealthRouting(healthNs, vethPeerName, hostAddressing); err != nil {
+		return nil, fmt.Errorf("Error while configuring routes: %s", err)
 	}
 
 	// Add the endpoint
 	if err := endpointmanager.AddEndpoint(owner, ep, "Create cilium-health endpoint"); err != nil {
-		return fmt.Errorf("Error while adding endpoint: %s", err)
+		return nil, fmt.Errorf("Error while adding endpoint: %s", err)
 	}
 
 	// Propagate health IPs to all other nodes
 	if k8s.IsEnabled() {
-		err := k8s.AnnotateNode(k8s.Client(), node.GetName(), nil, nil, ip4, ip6)
+		annotator, err := k8s.Client().AnnotateNode(context.Background(), node.GetName(), nil, nil, ip4, ip6, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot annotate node CIDR range data: %s", err)
+		}
+		syncCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = annotator.WaitForInitialSync(syncCtx)
+		cancel()
 		if err != nil {
-			return fmt.Errorf("Cannot annotate node CIDR range data: %s", err)
+			return nil, fmt.Errorf("Cannot annotate node CIDR range data: %s", err)
 		}
 	}
 
-	client, err = healthPkg.NewClient(fmt.Sprintf("tcp://%s:%d", ip4, defaults.HTTPPathPort))
+	newClient, err := healthPkg.NewClient(fmt.Sprintf("tcp://%s:%d", ip4, defaults.HTTPPathPort))
 	if err != nil {
-		return fmt.Errorf("Cannot establish connection to health endpoint: %s", err)
+		return nil, fmt.Errorf("Cannot establish connection to health endpoint: %s", err)
 	}
+	clientMutex.Lock()
+	client = newClient
+	clientMutex.Unlock()
 
-	return nil
+	return cmd, nil
 }
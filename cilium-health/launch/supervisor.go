@@ -0,0 +1,285 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package launch
+
+import (
+	"context"
+	"math/rand"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cilium/cilium/api/v1/models"
+	"github.com/cilium/cilium/pkg/endpoint"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pingInterval is how often the supervisor checks the endpoint's
+	// liveness via PingEndpoint while it is supposed to be running.
+	pingInterval = 5 * time.Second
+
+	// maxConsecutivePingFailures is the number of consecutive failed
+	// pings that triggers a restart even though the process is still
+	// alive, e.g. because it is wedged.
+	maxConsecutivePingFailures = 3
+
+	initialBackoff = time.Second
+	maxBackoff     = 60 * time.Second
+)
+
+var (
+	healthEndpointRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "health_endpoint",
+		Name:      "restarts_total",
+		Help:      "Number of times the cilium-health endpoint has been restarted",
+	})
+	healthEndpointLastExitCode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "health_endpoint",
+		Name:      "last_exit_code",
+		Help:      "Exit code of the most recent cilium-health endpoint process",
+	})
+	healthEndpointUptimeSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "health_endpoint",
+		Name:      "last_uptime_seconds",
+		Help:      "Duration the most recent cilium-health endpoint process ran before exiting",
+	})
+)
+
+func init() {
+	metrics.MustRegister(healthEndpointRestarts, healthEndpointLastExitCode, healthEndpointUptimeSeconds)
+}
+
+// spawnFunc matches LaunchAsEndpoint's signature, so the Supervisor can be
+// pointed at a fake in tests instead of actually spawning cilium-health. The
+// returned *exec.Cmd is the one the Supervisor then waits and, if needed,
+// kills, instead of relying on a shared global.
+type spawnFunc func(owner endpoint.Owner, hostAddressing *models.NodeAddressing) (*exec.Cmd, error)
+
+// Supervisor owns the cilium-health endpoint process, restarting it with
+// exponential, jittered, capped backoff if it exits unexpectedly or stops
+// responding to pings, instead of the one-shot LaunchAsEndpoint leaving a
+// dead endpoint in place until the next agent restart.
+type Supervisor struct {
+	owner          endpoint.Owner
+	hostAddressing *models.NodeAddressing
+	spawn          spawnFunc
+
+	mutex        lock.Mutex
+	restartCount int
+	lastExitCode int
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewSupervisor creates a Supervisor for the cilium-health endpoint. Call
+// Run to start it.
+func NewSupervisor(owner endpoint.Owner, hostAddressing *models.NodeAddressing) *Supervisor {
+	return &Supervisor{
+		owner:          owner,
+		hostAddressing: hostAddressing,
+		spawn:          LaunchAsEndpoint,
+		stopChan:       make(chan struct{}),
+	}
+}
+
+// Run starts the supervisor loop in the background. It does not block.
+func (s *Supervisor) Run() {
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Shutdown stops the supervisor and the cilium-health endpoint it owns,
+// waiting for the current iteration to notice unless ctx is canceled first.
+func (s *Supervisor) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopChan) })
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the number of restarts performed so far and the exit code
+// of the most recently observed cilium-health process exit.
+func (s *Supervisor) Status() (restarts int, lastExitCode int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.restartCount, s.lastExitCode
+}
+
+func (s *Supervisor) run() {
+	defer s.wg.Done()
+
+	backoff := initialBackoff
+	first := true
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		default:
+		}
+
+		if !first {
+			CleanupEndpoint(s.owner)
+		}
+
+		cmd, err := s.spawn(s.owner, s.hostAddressing)
+		if err != nil {
+			log.WithError(err).Warning("cilium-health endpoint failed to start, will retry")
+			if !s.sleep(backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		restarted := !first
+		first = false
+		backoff = initialBackoff
+		s.mutex.Lock()
+		if restarted {
+			s.restartCount++
+		}
+		restarts := s.restartCount
+		s.mutex.Unlock()
+		if restarted {
+			healthEndpointRestarts.Inc()
+		}
+		log.WithField("restarts", restarts).Info("cilium-health endpoint started")
+
+		startTime := time.Now()
+		exitCode, cause := s.waitForExit(cmd)
+		uptime := time.Since(startTime)
+
+		s.mutex.Lock()
+		s.lastExitCode = exitCode
+		s.mutex.Unlock()
+		healthEndpointLastExitCode.Set(float64(exitCode))
+		healthEndpointUptimeSeconds.Set(uptime.Seconds())
+
+		if cause == "shutdown" {
+			return
+		}
+
+		log.WithFields(logrus.Fields{
+			"exitCode": exitCode,
+			"cause":    cause,
+			"uptime":   uptime,
+		}).Warning("cilium-health endpoint exited unexpectedly, restarting")
+	}
+}
+
+// waitForExit blocks until cmd exits, the supervisor is asked to stop, or
+// PingEndpoint fails maxConsecutivePingFailures times in a row, in which
+// case it kills cmd itself before returning. It returns the process's exit
+// code (or -1 if that could not be determined; always 0 when it returns
+// because of a shutdown) and a short string describing why it returned.
+func (s *Supervisor) waitForExit(cmd *exec.Cmd) (exitCode int, cause string) {
+	exitChan := make(chan error, 1)
+	go func() { exitChan <- cmd.Wait() }()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	consecutiveFailures := 0
+	for {
+		select {
+		case err := <-exitChan:
+			return exitCodeFromError(err), "process exited"
+
+		case <-s.stopChan:
+			if cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+			<-exitChan
+			return 0, "shutdown"
+
+		case <-ticker.C:
+			if err := PingEndpoint(); err != nil {
+				consecutiveFailures++
+				log.WithError(err).WithField("consecutiveFailures", consecutiveFailures).
+					Debug("cilium-health endpoint ping failed")
+				if consecutiveFailures < maxConsecutivePingFailures {
+					continue
+				}
+				if cmd.Process != nil {
+					cmd.Process.Kill()
+				}
+				err := <-exitChan
+				return exitCodeFromError(err), "unresponsive"
+			}
+			consecutiveFailures = 0
+		}
+	}
+}
+
+// sleep waits for d or until the supervisor is asked to stop, returning
+// false in the latter case.
+func (s *Supervisor) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.stopChan:
+		return false
+	}
+}
+
+// nextBackoff doubles d, jitters it by up to +/-20%, and caps it at
+// maxBackoff.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	jitter := time.Duration(rand.Int63n(int64(d) / 5))
+	if rand.Intn(2) == 0 {
+		d += jitter
+	} else {
+		d -= jitter
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+func exitCodeFromError(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package launch
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/api/v1/models"
+	"github.com/cilium/cilium/pkg/endpoint"
+)
+
+var errSpawnFailed = fmt.Errorf("fake spawn failure")
+
+// startFakeProcess starts a short-lived real process so *exec.Cmd's
+// Wait/Kill machinery behaves exactly as it would for a real cilium-health
+// process, without actually spawning cilium-health.
+func startFakeProcess(t *testing.T, shellScript string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", shellScript)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start fake process: %s", err)
+	}
+	return cmd
+}
+
+func newTestSupervisor(spawn spawnFunc) *Supervisor {
+	return &Supervisor{
+		spawn:    spawn,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// TestSupervisorRestartsOnSpawnFailure exercises the retry path taken when
+// spawn itself fails (e.g. veth creation failed), without ever reaching
+// waitForExit.
+func TestSupervisorRestartsOnSpawnFailure(t *testing.T) {
+	var attempts int
+	done := make(chan struct{})
+
+	s := newTestSupervisor(func(owner endpoint.Owner, hostAddressing *models.NodeAddressing) (*exec.Cmd, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errSpawnFailed
+		}
+		close(done)
+		return startFakeProcess(t, "sleep 30"), nil
+	})
+	s.wg.Add(1)
+	go s.run()
+	defer func() {
+		s.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-done:
+		if attempts != 3 {
+			t.Fatalf("expected exactly 3 spawn attempts, got %d", attempts)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("spawn was not retried after failure")
+	}
+}
+
+// TestSupervisorWaitForExitProcessExit covers the crash path: the endpoint
+// process exits on its own, and waitForExit reports its exit code.
+func TestSupervisorWaitForExitProcessExit(t *testing.T) {
+	s := newTestSupervisor(nil)
+	cmd := startFakeProcess(t, "exit 7")
+
+	exitCode, cause := s.waitForExit(cmd)
+
+	if cause != "process exited" {
+		t.Fatalf("expected cause %q, got %q", "process exited", cause)
+	}
+	if exitCode != 7 {
+		t.Fatalf("expected exit code 7, got %d", exitCode)
+	}
+}
+
+// TestSupervisorWaitForExitShutdown covers the clean-shutdown path:
+// closing stopChan while the endpoint is still running kills it and
+// reports "shutdown" rather than treating the resulting exit as a crash.
+func TestSupervisorWaitForExitShutdown(t *testing.T) {
+	s := newTestSupervisor(nil)
+	cmd := startFakeProcess(t, "sleep 30")
+
+	resultChan := make(chan struct {
+		exitCode int
+		cause    string
+	}, 1)
+	go func() {
+		exitCode, cause := s.waitForExit(cmd)
+		resultChan <- struct {
+			exitCode int
+			cause    string
+		}{exitCode, cause}
+	}()
+
+	close(s.stopChan)
+
+	select {
+	case result := <-resultChan:
+		if result.cause != "shutdown" {
+			t.Fatalf("expected cause %q, got %q", "shutdown", result.cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForExit did not return after shutdown")
+	}
+}
+
+// TestSupervisorWaitForExitUnresponsive covers the hang path: the process
+// stays alive but PingEndpoint keeps failing (here because no endpoint
+// client has ever been initialized), so waitForExit kills it and reports
+// "unresponsive" instead of waiting on it forever.
+func TestSupervisorWaitForExitUnresponsive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow ping-timeout test in short mode")
+	}
+
+	clientMutex.Lock()
+	client = nil
+	clientMutex.Unlock()
+
+	s := newTestSupervisor(nil)
+	cmd := startFakeProcess(t, "sleep 30")
+
+	exitCode, cause := s.waitForExit(cmd)
+
+	if cause != "unresponsive" {
+		t.Fatalf("expected cause %q, got %q", "unresponsive", cause)
+	}
+	if exitCode != -1 {
+		t.Fatalf("expected exit code -1 for a killed process, got %d", exitCode)
+	}
+}
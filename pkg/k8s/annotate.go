@@ -19,16 +19,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/cilium/cilium/pkg/annotation"
 	"github.com/cilium/cilium/pkg/cidr"
 	"github.com/cilium/cilium/pkg/controller"
 	clientset "github.com/cilium/cilium/pkg/k8s/client/clientset/versioned"
+	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 // K8sClient is a wrapper around kubernetes.Interface.
@@ -43,50 +50,291 @@ type K8sCiliumClient struct {
 	clientset.Interface
 }
 
-func updateNodeAnnotation(c kubernetes.Interface, nodeName string, v4CIDR, v6CIDR *cidr.CIDR, v4HealthIP, v6HealthIP, v4CiliumHostIP, v6CiliumHostIP net.IP) error {
-	annotations := map[string]string{}
+var (
+	nodeAnnotationRetries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "k8s",
+		Name:      "node_annotation_consecutive_failures",
+		Help:      "Number of consecutive failures to reconcile this node's annotations",
+	})
+	nodeAnnotationLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "k8s",
+		Name:      "node_annotation_last_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful node annotation reconciliation",
+	})
+)
+
+func init() {
+	metrics.MustRegister(nodeAnnotationRetries, nodeAnnotationLastSuccess)
+}
 
-	if v4CIDR != nil {
-		annotations[annotation.V4CIDRName] = v4CIDR.String()
+// withContext runs fn in a goroutine and returns its result, unless ctx is
+// canceled first, in which case ctx.Err() is returned immediately. It exists
+// because the generated clientset methods used below predate context.Context
+// support.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	if v6CIDR != nil {
-		annotations[annotation.V6CIDRName] = v6CIDR.String()
+}
+
+// NodeAnnotationProvider supplies a subset of the annotations that should be
+// present on this node. Each provider owns a fixed set of annotation keys;
+// multiple providers (CIDRs and health IPs, WireGuard pubkey, BGP router-ID,
+// IPv6 ULA prefix, ...) can be registered with the same NodeAnnotator
+// without it needing to know anything about any of them ahead of time.
+type NodeAnnotationProvider interface {
+	// Name identifies the provider in logs.
+	Name() string
+	// Keys returns the set of annotation keys this provider owns. A key
+	// this provider owns that is absent from Annotate()'s result is
+	// removed from the node.
+	Keys() []string
+	// Annotate returns the annotations this provider currently wants on
+	// the node. It may return a subset of Keys() when a value is not yet
+	// known.
+	Annotate() map[string]string
+}
+
+// nodeAnnotatorControllerName is the name under which NodeAnnotator
+// registers its reconciliation controller, used to stop it again on
+// Shutdown.
+const nodeAnnotatorControllerName = "update-k8s-node-annotations"
+
+// NodeAnnotator reconciles the annotations contributed by a set of
+// NodeAnnotationProviders onto a single Kubernetes node, issuing one
+// strategic-merge patch per reconcile instead of one apiserver call per
+// annotation.
+type NodeAnnotator struct {
+	client    kubernetes.Interface
+	nodeName  string
+	nodeStore cache.Store
+	providers []NodeAnnotationProvider
+
+	mgr *controller.Manager
+
+	mutex     lock.RWMutex
+	attempts  int
+	lastError error
+
+	syncedOnce sync.Once
+	synced     chan struct{}
+}
+
+// NewNodeAnnotator creates a NodeAnnotator for nodeName. nodeStore, when
+// non-nil, is consulted for the node's current annotations instead of
+// issuing a live Get on every reconcile; it is expected to be backed by a
+// Node informer.
+func NewNodeAnnotator(client kubernetes.Interface, nodeName string, nodeStore cache.Store, providers ...NodeAnnotationProvider) *NodeAnnotator {
+	return &NodeAnnotator{
+		client:    client,
+		nodeName:  nodeName,
+		nodeStore: nodeStore,
+		providers: providers,
+		mgr:       controller.NewManager(),
+		synced:    make(chan struct{}),
 	}
+}
+
+// Run starts the reconciliation controller. It does not block; use
+// WaitForInitialSync to wait for the first successful reconcile, and
+// Shutdown to stop it.
+func (a *NodeAnnotator) Run() {
+	a.mgr.UpdateController(nodeAnnotatorControllerName,
+		controller.ControllerParams{
+			DoFunc: a.reconcileAndTrack,
+		})
+}
+
+// Shutdown stops the reconciliation controller, waiting for its current run
+// to finish unless ctx is canceled first.
+func (a *NodeAnnotator) Shutdown(ctx context.Context) error {
+	return withContext(ctx, func() error {
+		a.mgr.RemoveControllerAndWait(nodeAnnotatorControllerName)
+		return nil
+	})
+}
 
-	if v4HealthIP != nil {
-		annotations[annotation.V4HealthName] = v4HealthIP.String()
+// WaitForInitialSync blocks until the node's annotations have been
+// successfully reconciled at least once, or ctx is canceled.
+func (a *NodeAnnotator) WaitForInitialSync(ctx context.Context) error {
+	select {
+	case <-a.synced:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	if v6HealthIP != nil {
-		annotations[annotation.V6HealthName] = v6HealthIP.String()
+}
+
+// Status returns the number of consecutive reconcile failures and the most
+// recent error, if any. It exists so that callers can surface retry
+// visibility without scraping debug logs.
+func (a *NodeAnnotator) Status() (attempts int, lastError error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.attempts, a.lastError
+}
+
+func (a *NodeAnnotator) reconcileAndTrack(ctx context.Context) error {
+	err := a.reconcile(ctx)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err != nil {
+		a.attempts++
+		a.lastError = err
+		nodeAnnotationRetries.Set(float64(a.attempts))
+		return err
 	}
 
-	if v4CiliumHostIP != nil {
-		annotations[annotation.CiliumHostIP] = v4CiliumHostIP.String()
+	a.attempts = 0
+	a.lastError = nil
+	nodeAnnotationRetries.Set(0)
+	nodeAnnotationLastSuccess.SetToCurrentTime()
+	a.syncedOnce.Do(func() { close(a.synced) })
+	return nil
+}
+
+// desiredAndOwnedKeys merges every provider's desired annotations and
+// collects the full set of keys providers own, so that a key whose
+// provider stops returning it is recognized as needing removal.
+func (a *NodeAnnotator) desiredAndOwnedKeys() (desired map[string]string, owned map[string]struct{}) {
+	desired = map[string]string{}
+	owned = map[string]struct{}{}
+	for _, p := range a.providers {
+		for _, key := range p.Keys() {
+			owned[key] = struct{}{}
+		}
+		for key, value := range p.Annotate() {
+			desired[key] = value
+		}
 	}
+	return desired, owned
+}
 
-	if v6CiliumHostIP != nil {
-		annotations[annotation.CiliumHostIPv6] = v6CiliumHostIP.String()
+func (a *NodeAnnotator) currentAnnotations(ctx context.Context) (map[string]string, error) {
+	if a.nodeStore != nil {
+		if obj, exists, err := a.nodeStore.GetByKey(a.nodeName); err == nil && exists {
+			if node, ok := obj.(*v1.Node); ok {
+				return node.Annotations, nil
+			}
+		}
 	}
 
-	if len(annotations) == 0 {
+	var node *v1.Node
+	err := withContext(ctx, func() error {
+		var err error
+		node, err = a.client.CoreV1().Nodes().Get(a.nodeName, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node.Annotations, nil
+}
+
+// reconcile computes a single strategic-merge patch covering every key any
+// provider owns and, if the node's actual annotations differ from what the
+// providers want, applies it in one apiserver call.
+func (a *NodeAnnotator) reconcile(ctx context.Context) error {
+	desired, owned := a.desiredAndOwnedKeys()
+
+	actual, err := a.currentAnnotations(ctx)
+	if err != nil {
+		return err
+	}
+
+	patch := map[string]interface{}{}
+	for key := range owned {
+		wantValue, wanted := desired[key]
+		haveValue, have := actual[key]
+		switch {
+		case wanted && (!have || haveValue != wantValue):
+			patch[key] = wantValue
+		case !wanted && have:
+			patch[key] = nil
+		}
+	}
+
+	if len(patch) == 0 {
 		return nil
 	}
 
-	raw, err := json.Marshal(annotations)
+	raw, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	body := []byte(fmt.Sprintf(`{"metadata":{"annotations":%s}}`, raw))
+
+	err = withContext(ctx, func() error {
+		_, err := a.client.CoreV1().Nodes().Patch(a.nodeName, types.StrategicMergePatchType, body)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	patch := []byte(fmt.Sprintf(`{"metadata":{"annotations":%s}}`, raw))
 
-	_, err = c.CoreV1().Nodes().Patch(nodeName, types.StrategicMergePatchType, patch)
+	return SetNodeNetworkUnavailableFalse(a.client, a.nodeName)
+}
 
-	return err
+// cidrHealthProvider is the built-in NodeAnnotationProvider for the v4/v6
+// pod CIDRs, health IPs, and cilium-host IPs that AnnotateNode has always
+// published.
+type cidrHealthProvider struct {
+	v4CIDR, v6CIDR                 *cidr.CIDR
+	v4HealthIP, v6HealthIP         net.IP
+	v4CiliumHostIP, v6CiliumHostIP net.IP
 }
 
-// AnnotateNode writes v4 and v6 CIDRs and health IPs in the given k8s node name.
-// In case of failure while updating the node, this function while spawn a go
-// routine to retry the node update indefinitely.
-func (k8sCli K8sClient) AnnotateNode(nodeName string, v4CIDR, v6CIDR *cidr.CIDR, v4HealthIP, v6HealthIP, v4CiliumHostIP, v6CiliumHostIP net.IP) error {
+func (p *cidrHealthProvider) Name() string { return "cidr-health" }
+
+func (p *cidrHealthProvider) Keys() []string {
+	return []string{
+		annotation.V4CIDRName,
+		annotation.V6CIDRName,
+		annotation.V4HealthName,
+		annotation.V6HealthName,
+		annotation.CiliumHostIP,
+		annotation.CiliumHostIPv6,
+	}
+}
+
+func (p *cidrHealthProvider) Annotate() map[string]string {
+	annotations := map[string]string{}
+
+	if p.v4CIDR != nil {
+		annotations[annotation.V4CIDRName] = p.v4CIDR.String()
+	}
+	if p.v6CIDR != nil {
+		annotations[annotation.V6CIDRName] = p.v6CIDR.String()
+	}
+	if p.v4HealthIP != nil {
+		annotations[annotation.V4HealthName] = p.v4HealthIP.String()
+	}
+	if p.v6HealthIP != nil {
+		annotations[annotation.V6HealthName] = p.v6HealthIP.String()
+	}
+	if p.v4CiliumHostIP != nil {
+		annotations[annotation.CiliumHostIP] = p.v4CiliumHostIP.String()
+	}
+	if p.v6CiliumHostIP != nil {
+		annotations[annotation.CiliumHostIPv6] = p.v6CiliumHostIP.String()
+	}
+
+	return annotations
+}
+
+// AnnotateNode writes v4 and v6 CIDRs and health IPs in the given k8s node
+// name. In case of failure while updating the node, this function spawns a
+// goroutine to retry the node update until ctx is canceled; use the returned
+// NodeAnnotator's WaitForInitialSync or Status to observe its progress.
+func (k8sCli K8sClient) AnnotateNode(ctx context.Context, nodeName string, v4CIDR, v6CIDR *cidr.CIDR, v4HealthIP, v6HealthIP, v4CiliumHostIP, v6CiliumHostIP net.IP) (*NodeAnnotator, error) {
 	scopedLog := log.WithFields(logrus.Fields{
 		logfields.NodeName:       nodeName,
 		logfields.V4Prefix:       v4CIDR,
@@ -98,17 +346,25 @@ func (k8sCli K8sClient) AnnotateNode(nodeName string, v4CIDR, v6CIDR *cidr.CIDR,
 	})
 	scopedLog.Debug("Updating node annotations with node CIDRs")
 
-	controller.NewManager().UpdateController("update-k8s-node-annotations",
-		controller.ControllerParams{
-			DoFunc: func(_ context.Context) error {
-				err := updateNodeAnnotation(k8sCli, nodeName, v4CIDR, v6CIDR, v4HealthIP, v6HealthIP, v4CiliumHostIP, v6CiliumHostIP)
-				if err != nil {
-					scopedLog.WithFields(logrus.Fields{}).WithError(err).Warn("Unable to patch node resource with annotation")
-					return err
-				}
-				return SetNodeNetworkUnavailableFalse(k8sCli, nodeName)
-			},
-		})
+	provider := &cidrHealthProvider{
+		v4CIDR:         v4CIDR,
+		v6CIDR:         v6CIDR,
+		v4HealthIP:     v4HealthIP,
+		v6HealthIP:     v6HealthIP,
+		v4CiliumHostIP: v4CiliumHostIP,
+		v6CiliumHostIP: v6CiliumHostIP,
+	}
 
-	return nil
+	annotator := NewNodeAnnotator(k8sCli, nodeName, nil, provider)
+	annotator.Run()
+
+	// ctx is only used to bound the retry controller's lifetime: once it is
+	// canceled (e.g. the agent is shutting down), stop reconciling instead
+	// of retrying indefinitely.
+	go func() {
+		<-ctx.Done()
+		annotator.Shutdown(context.Background())
+	}()
+
+	return annotator, nil
 }
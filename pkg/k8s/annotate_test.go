@@ -0,0 +1,70 @@
+// Copyright 2016-2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// TestNodeAnnotatorReconcileReturnsOnContextCancel uses a fake clientset
+// whose Get reactor blocks until released, standing in for an apiserver
+// that never responds, and asserts that reconcile (and the withContext call
+// it makes under the hood) returns context.Canceled promptly instead of
+// waiting on the call forever.
+func TestNodeAnnotatorReconcileReturnsOnContextCancel(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	called := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	clientset.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-unblock
+		return true, &v1.Node{}, nil
+	})
+
+	annotator := NewNodeAnnotator(clientset, "node1", nil, &cidrHealthProvider{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- annotator.reconcile(ctx) }()
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("Get was never called")
+	}
+
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reconcile did not return after context cancellation")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identitybackend
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// FlagIdentityGCInterval is the operator flag name for CRDBackendConfiguration.GCInterval.
+	FlagIdentityGCInterval = "identity-gc-interval"
+
+	// FlagIdentityHeartbeatTimeout is the operator flag name for
+	// CRDBackendConfiguration.IdentityHeartbeatTimeout.
+	FlagIdentityHeartbeatTimeout = "identity-heartbeat-timeout"
+
+	defaultIdentityGCInterval       = 15 * time.Minute
+	defaultIdentityHeartbeatTimeout = 15 * time.Minute
+)
+
+var (
+	identitiesScanned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity_gc",
+		Name:      "identities_scanned_total",
+		Help:      "Number of CiliumIdentity CRDs examined by the identity garbage collector",
+	})
+	identitiesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity_gc",
+		Name:      "identities_removed_total",
+		Help:      "Number of orphaned CiliumIdentity CRDs deleted by the identity garbage collector",
+	})
+	identitiesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity_gc",
+		Name:      "identities_skipped_total",
+		Help:      "Number of CiliumIdentity CRDs the identity garbage collector failed to reconcile and will retry",
+	})
+	identityNodesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity_gc",
+		Name:      "stale_nodes_removed_total",
+		Help:      "Number of stale node references removed from CiliumIdentity status by the identity garbage collector",
+	})
+)
+
+func init() {
+	metrics.MustRegister(identitiesScanned, identitiesRemoved, identitiesSkipped, identityNodesRemoved)
+}
+
+// RegisterFlags adds the identity garbage collector's flags to flags. The
+// operator command is expected to call this alongside its other
+// RegisterFlags calls, then populate CRDBackendConfiguration.GCInterval and
+// IdentityHeartbeatTimeout from the parsed values (e.g. via
+// viper.GetDuration(FlagIdentityGCInterval)) before constructing the "crd"
+// or "crd-slice" backend; RunGC uses the package defaults until then.
+func RegisterFlags(flags *pflag.FlagSet) {
+	flags.Duration(FlagIdentityGCInterval, defaultIdentityGCInterval,
+		"Interval between CiliumIdentity garbage collection runs")
+	flags.Duration(FlagIdentityHeartbeatTimeout, defaultIdentityHeartbeatTimeout,
+		"Grace period a CiliumIdentity with no live node references is kept before being deleted")
+}
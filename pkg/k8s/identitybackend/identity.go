@@ -21,6 +21,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cilium/cilium/pkg/allocator"
 	"github.com/cilium/cilium/pkg/idpool"
@@ -46,8 +47,42 @@ var (
 	log = logging.DefaultLogger.WithField(logfields.LogSubsys, "crd-allocator")
 )
 
+// withContext runs fn to completion, but returns ctx.Err() as soon as ctx is
+// canceled if that happens first. The generated CiliumIdentity client in use
+// here predates context-aware method signatures, so this is how callers
+// (e.g. agent/operator shutdown) get prompt cancellation of in-flight
+// apiserver calls instead of waiting for them to finish or time out on
+// their own.
+func withContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func NewCRDBackend(c CRDBackendConfiguration) (allocator.Backend, error) {
-	return &crdBackend{CRDBackendConfiguration: c}, nil
+	backend := &crdBackend{CRDBackendConfiguration: c}
+	backend.statusCoalescer = newStatusCoalescer(c.Client.CiliumV2().CiliumIdentities(), c.StatusCoalesceInterval, c.StatusCoalesceThreshold)
+	go backend.statusCoalescer.Run()
+
+	// ShutdownCtx, when set, lets the backend flush on its own instead of
+	// requiring every caller to remember to invoke Shutdown explicitly:
+	// the agent/operator root context is already canceled as the first
+	// step of graceful termination, so tying into it here means buffered
+	// mutations are not silently dropped on process exit even if nothing
+	// downstream calls FlushStatusUpdates/Shutdown directly.
+	if c.ShutdownCtx != nil {
+		go func() {
+			<-c.ShutdownCtx.Done()
+			backend.Shutdown(context.Background())
+		}()
+	}
+
+	return backend, nil
 }
 
 type CRDBackendConfiguration struct {
@@ -55,15 +90,75 @@ type CRDBackendConfiguration struct {
 	Store    cache.Store
 	Client   clientset.Interface
 	KeyType  allocator.AllocatorKey
+
+	// StatusCoalesceInterval is the maximum time a node reference
+	// mutation may sit buffered before being flushed to the apiserver.
+	// Defaults to defaultCoalesceInterval when zero.
+	StatusCoalesceInterval time.Duration
+
+	// StatusCoalesceThreshold is the number of identities with pending
+	// status mutations that triggers an immediate flush instead of
+	// waiting for StatusCoalesceInterval to elapse. Defaults to
+	// defaultCoalesceThreshold when zero.
+	StatusCoalesceThreshold int
+
+	// NodesStore is the local cache of the cluster's live v1.Node
+	// objects. RunGC cross-references it against each CiliumIdentity's
+	// Status.Nodes to find stale node references; if nil, RunGC only
+	// considers identities whose Status.Nodes map is already empty.
+	NodesStore cache.Store
+
+	// IsLeader reports whether this process currently holds the
+	// operator's leader-election lock. RunGC is a no-op when it returns
+	// false. A nil IsLeader is treated as "always leader", for backends
+	// constructed outside the operator (e.g. in tests).
+	IsLeader func() bool
+
+	// GCInterval is the expected spacing between calls to RunGC, used to
+	// translate IdentityHeartbeatTimeout into a number of rounds an
+	// identity must be observed empty/orphaned before it is deleted.
+	// Defaults to defaultIdentityGCInterval when zero.
+	GCInterval time.Duration
+
+	// IdentityHeartbeatTimeout is the grace period an identity with an
+	// empty (or fully stale) Status.Nodes map is kept around before being
+	// deleted. Defaults to defaultIdentityHeartbeatTimeout when zero.
+	IdentityHeartbeatTimeout time.Duration
+
+	// GCDryRun, when true, logs the deletions and node-reference removals
+	// RunGC would have performed without issuing them.
+	GCDryRun bool
+
+	// ShutdownCtx, when set, is watched for cancellation to automatically
+	// flush and stop the status coalescer, so that callers do not need to
+	// remember to invoke Shutdown explicitly during graceful termination.
+	// Typically set to the agent/operator's root context.
+	ShutdownCtx context.Context
 }
 
 type crdBackend struct {
 	CRDBackendConfiguration
+	statusCoalescer *statusCoalescer
 }
 
 func (c *crdBackend) DeleteAllKeys() {
 }
 
+// FlushStatusUpdates synchronously writes out any buffered CiliumIdentity
+// status mutations. It is called during agent/operator shutdown to avoid
+// losing node reference updates that are still sitting in the coalescing
+// buffer.
+func (c *crdBackend) FlushStatusUpdates(ctx context.Context) error {
+	return c.statusCoalescer.Flush(ctx)
+}
+
+// Shutdown stops the background status coalescer, flushing any pending
+// mutations first. ctx bounds how long the final flush waits on the
+// apiserver before giving up.
+func (c *crdBackend) Shutdown(ctx context.Context) {
+	c.statusCoalescer.Stop(ctx)
+}
+
 // sanitizeK8sLabels strips the 'k8s:' prefix in the labels generated by
 // AllocatorKey.GetAsMap (when the key is k8s labels). In the CRD identity case
 // we map the labels directly to the ciliumidentity CRD instance, and
@@ -107,8 +202,10 @@ func (c *crdBackend) AllocateID(ctx context.Context, id idpool.ID, key allocator
 		},
 	}
 
-	_, err := c.Client.CiliumV2().CiliumIdentities().Create(identity)
-	return err
+	return withContext(ctx, func() error {
+		_, err := c.Client.CiliumV2().CiliumIdentities().Create(identity)
+		return err
+	})
 }
 
 func (c *crdBackend) AllocateIDIfLocked(ctx context.Context, id idpool.ID, key allocator.AllocatorKey, lock kvstore.KVLocker) error {
@@ -124,6 +221,37 @@ type JSONPatch struct {
 	Value interface{} `json:"value"`
 }
 
+// ensureStatusNodes makes sure identity has a non-nil Status.Nodes map,
+// creating it with a "test"+"add" patch pair if necessary. This only needs
+// to run once per identity (the first time a node acquires a reference to
+// it), so it is not worth routing through the status coalescer.
+func (c *crdBackend) ensureStatusNodes(ctx context.Context, identity *types.Identity) error {
+	patch, err := json.Marshal([]JSONPatch{
+		{
+			OP:    "test",
+			Path:  "/status",
+			Value: nil,
+		},
+		{
+			OP:   "add",
+			Path: "/status",
+			Value: v2.IdentityStatus{
+				Nodes: map[string]metav1.Time{
+					c.NodeName: metav1.Now(),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return withContext(ctx, func() error {
+		_, err := c.Client.CiliumV2().CiliumIdentities().Patch(identity.GetName(), k8sTypes.JSONPatchType, patch, "status")
+		return err
+	})
+}
+
 // AcquireReference updates the status field of the CRD corresponding to id
 // with this node. This marks that CRD as used by this node, and will stop it
 // being garbage collected.
@@ -135,52 +263,28 @@ func (c *crdBackend) AcquireReference(ctx context.Context, id idpool.ID, key all
 	}
 
 	capabilities := k8sversion.Capabilities()
-	identityOps := c.Client.CiliumV2().CiliumIdentities()
+	if !capabilities.Patch {
+		return c.acquireReferenceLegacy(ctx, identity, capabilities)
+	}
 
-	var err error
-	if capabilities.Patch {
-		var patch []byte
-		patch, err = json.Marshal([]JSONPatch{
-			{
-				OP:    "test",
-				Path:  "/status",
-				Value: nil,
-			},
-			{
-				OP:   "add",
-				Path: "/status",
-				Value: v2.IdentityStatus{
-					Nodes: map[string]metav1.Time{
-						c.NodeName: metav1.Now(),
-					},
-				},
-			},
-		})
-		if err != nil {
-			return err
+	if identity.Status.Nodes == nil {
+		if err := c.ensureStatusNodes(ctx, identity); err != nil {
+			log.WithError(err).Debug("Error initializing status.nodes, attempting coalesced add")
 		}
+	}
 
-		_, err = identityOps.Patch(identity.GetName(), k8sTypes.JSONPatchType, patch, "status")
-		if err != nil {
-			patch, err = json.Marshal([]JSONPatch{
-				{
-					OP:    "replace",
-					Path:  "/status/nodes/" + c.NodeName,
-					Value: metav1.Now(),
-				},
-			})
-			if err != nil {
-				return err
-			}
-			_, err = identityOps.Patch(identity.GetName(), k8sTypes.JSONPatchType, patch, "status")
-		}
+	// The actual node reference write is buffered and merged with any
+	// other pending mutations for this identity by the status coalescer,
+	// which flushes on its own interval/threshold.
+	c.statusCoalescer.queueMutation(identity.GetName(), c.NodeName, nodeMutationAdd)
+	return nil
+}
 
-		if err == nil {
-			return nil
-		}
-		log.WithError(err).Debug("Error patching status. Continuing update via UpdateStatus")
-		/* fall through and attempt UpdateStatus() or Update() */
-	}
+// acquireReferenceLegacy is used against apiservers that do not support
+// Patch, where buffering would not save any round trips since every
+// mutation already has to read-modify-write the full object.
+func (c *crdBackend) acquireReferenceLegacy(ctx context.Context, identity *types.Identity, capabilities k8sversion.ServerCapabilities) error {
+	identityOps := c.Client.CiliumV2().CiliumIdentities()
 
 	identityCopy := identity.DeepCopy()
 	if identityCopy.Status.Nodes == nil {
@@ -192,7 +296,10 @@ func (c *crdBackend) AcquireReference(ctx context.Context, id idpool.ID, key all
 	}
 
 	if capabilities.UpdateStatus {
-		_, err = identityOps.UpdateStatus(identityCopy.CiliumIdentity)
+		err := withContext(ctx, func() error {
+			_, err := identityOps.UpdateStatus(identityCopy.CiliumIdentity)
+			return err
+		})
 		if err == nil {
 			return nil
 		}
@@ -200,12 +307,169 @@ func (c *crdBackend) AcquireReference(ctx context.Context, id idpool.ID, key all
 		/* fall through and attempt Update() */
 	}
 
-	_, err = identityOps.Update(identityCopy.CiliumIdentity)
-	return err
+	return withContext(ctx, func() error {
+		_, err := identityOps.Update(identityCopy.CiliumIdentity)
+		return err
+	})
 }
 
+// RunGC removes stale node references and orphaned CiliumIdentity CRDs. It
+// only does work on the leader-elected operator instance: staleKeysPrevRound
+// counts, keyed by identity name, how many consecutive rounds each identity
+// has been observed with an empty (or fully stale) Status.Nodes map, and is
+// threaded back in on the next call so the grace period survives across
+// invocations without needing its own timer.
 func (c *crdBackend) RunGC(ctx context.Context, staleKeysPrevRound map[string]uint64) (map[string]uint64, error) {
-	return nil, nil
+	if c.IsLeader != nil && !c.IsLeader() {
+		return staleKeysPrevRound, nil
+	}
+	if c.Store == nil {
+		return staleKeysPrevRound, nil
+	}
+
+	liveNodes := c.liveNodeSet()
+	graceRounds := c.gcGraceRounds()
+
+	next := map[string]uint64{}
+	for _, obj := range c.Store.List() {
+		identity, ok := obj.(*types.Identity)
+		if !ok {
+			continue
+		}
+		name := identity.GetName()
+		identitiesScanned.Inc()
+
+		empty, err := c.pruneStaleNodes(ctx, name, identity, liveNodes)
+		if err != nil {
+			log.WithError(err).WithField(logfields.Identity, name).
+				Warning("Unable to remove stale node references from CiliumIdentity")
+			identitiesSkipped.Inc()
+			next[name] = staleKeysPrevRound[name]
+			continue
+		}
+		if !empty {
+			continue
+		}
+
+		rounds := staleKeysPrevRound[name] + 1
+		if rounds <= graceRounds {
+			next[name] = rounds
+			continue
+		}
+
+		if c.GCDryRun {
+			log.WithField(logfields.Identity, name).
+				Info("Would delete orphaned CiliumIdentity (dry-run)")
+			continue
+		}
+
+		if err := c.deleteIfStillEmpty(ctx, name, identity.GetResourceVersion()); err != nil {
+			log.WithError(err).WithField(logfields.Identity, name).
+				Debug("Unable to delete orphaned CiliumIdentity, will retry next round")
+			identitiesSkipped.Inc()
+			next[name] = rounds
+			continue
+		}
+
+		identitiesRemoved.Inc()
+	}
+
+	return next, nil
+}
+
+// gcGraceRounds converts IdentityHeartbeatTimeout into a number of RunGC
+// invocations using GCInterval as the expected spacing between them.
+func (c *crdBackend) gcGraceRounds() uint64 {
+	interval := c.GCInterval
+	if interval <= 0 {
+		interval = defaultIdentityGCInterval
+	}
+	timeout := c.IdentityHeartbeatTimeout
+	if timeout <= 0 {
+		timeout = defaultIdentityHeartbeatTimeout
+	}
+	if rounds := uint64(timeout / interval); rounds > 0 {
+		return rounds
+	}
+	return 1
+}
+
+// liveNodeSet returns the set of node names currently known to exist, or
+// nil if no node informer cache was configured (in which case stale node
+// pruning is skipped and only identities with an already-empty Status.Nodes
+// map are considered for deletion).
+func (c *crdBackend) liveNodeSet() map[string]struct{} {
+	if c.NodesStore == nil {
+		return nil
+	}
+	live := make(map[string]struct{})
+	for _, obj := range c.NodesStore.List() {
+		if node, ok := obj.(*v1.Node); ok {
+			live[node.GetName()] = struct{}{}
+		}
+	}
+	return live
+}
+
+// pruneStaleNodes removes the Status.Nodes entries of identity that
+// reference nodes not present in liveNodes (a nil liveNodes leaves
+// Status.Nodes untouched), and reports whether the identity's Status.Nodes
+// map is now empty.
+func (c *crdBackend) pruneStaleNodes(ctx context.Context, name string, identity *types.Identity, liveNodes map[string]struct{}) (empty bool, err error) {
+	if len(identity.Status.Nodes) == 0 {
+		return true, nil
+	}
+	if liveNodes == nil {
+		return false, nil
+	}
+
+	var stale []string
+	for node := range identity.Status.Nodes {
+		if _, alive := liveNodes[node]; !alive {
+			stale = append(stale, node)
+		}
+	}
+	if len(stale) == 0 {
+		return false, nil
+	}
+
+	if c.GCDryRun {
+		log.WithFields(logrus.Fields{
+			logfields.Identity: name,
+			"staleNodes":       stale,
+		}).Info("Would remove stale node references from CiliumIdentity (dry-run)")
+		return len(stale) == len(identity.Status.Nodes), nil
+	}
+
+	ops := make([]JSONPatch, 0, len(stale))
+	for _, node := range stale {
+		ops = append(ops, JSONPatch{OP: "delete", Path: "/status/nodes/" + node})
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return false, err
+	}
+	err = withContext(ctx, func() error {
+		_, err := c.Client.CiliumV2().CiliumIdentities().Patch(name, k8sTypes.JSONPatchType, patch, "status")
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	identityNodesRemoved.Add(float64(len(stale)))
+	return len(stale) == len(identity.Status.Nodes), nil
+}
+
+// deleteIfStillEmpty deletes identity name, guarded by a resourceVersion
+// precondition so that a concurrent AcquireReference landing between our
+// scan and this delete aborts the delete instead of racing it (TOCTOU).
+func (c *crdBackend) deleteIfStillEmpty(ctx context.Context, name, resourceVersion string) error {
+	return withContext(ctx, func() error {
+		return c.Client.CiliumV2().CiliumIdentities().Delete(name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+		})
+	})
 }
 
 // UpdateKey refreshes the reference that this node is using this key->ID
@@ -348,37 +612,33 @@ func (c *crdBackend) Release(ctx context.Context, key allocator.AllocatorKey) (e
 		return fmt.Errorf("unable to release identity %s: identity is unused", key)
 	}
 
-	delete(identity.Status.Nodes, c.NodeName)
-
 	capabilities := k8sversion.Capabilities()
+	if !capabilities.Patch {
+		return c.releaseLegacy(ctx, identity, capabilities)
+	}
 
+	// Buffer the removal; the status coalescer keeps only the latest
+	// pending mutation per node, so a node that is released and
+	// re-acquired within one coalescing window still ends up referenced.
+	c.statusCoalescer.queueMutation(identity.GetName(), c.NodeName, nodeMutationDelete)
+	return nil
+}
+
+// releaseLegacy is used against apiservers that do not support Patch.
+func (c *crdBackend) releaseLegacy(ctx context.Context, identity *types.Identity, capabilities k8sversion.ServerCapabilities) error {
 	identityOps := c.Client.CiliumV2().CiliumIdentities()
-	if capabilities.Patch {
-		var patch []byte
-		patch, err = json.Marshal([]JSONPatch{
-			{
-				OP:   "delete",
-				Path: "/status/nodes/" + c.NodeName,
-			},
-		})
-		if err != nil {
-			return err
-		}
-		_, err = identityOps.Patch(identity.GetName(), k8sTypes.JSONPatchType, patch, "status")
-		if err == nil {
-			return nil
-		}
-		log.WithError(err).Debug("Error patching status. Continuing update via UpdateStatus")
-		/* fall through and attempt UpdateStatus() or Update() */
-	}
 
 	identityCopy := identity.DeepCopy()
 	if identityCopy.Status.Nodes == nil {
 		return nil
 	}
+	delete(identityCopy.Status.Nodes, c.NodeName)
 
 	if capabilities.UpdateStatus {
-		_, err = identityOps.UpdateStatus(identityCopy.CiliumIdentity)
+		err := withContext(ctx, func() error {
+			_, err := identityOps.UpdateStatus(identityCopy.CiliumIdentity)
+			return err
+		})
 		if err == nil {
 			return nil
 		}
@@ -386,8 +646,10 @@ func (c *crdBackend) Release(ctx context.Context, key allocator.AllocatorKey) (e
 		/* fall through and attempt Update() */
 	}
 
-	_, err = identityOps.Update(identityCopy.CiliumIdentity)
-	return err
+	return withContext(ctx, func() error {
+		_, err := identityOps.Update(identityCopy.CiliumIdentity)
+		return err
+	})
 }
 
 func (c *crdBackend) ListAndWatch(handler allocator.CacheMutations, stopChan chan struct{}) {
@@ -0,0 +1,60 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identitybackend
+
+import (
+	"fmt"
+
+	"github.com/cilium/cilium/pkg/allocator"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// BackendConstructor builds an allocator.Backend from a CRDBackendConfiguration.
+// Every registerable identity backend, regardless of how it stores data on
+// the apiserver, is configured and selected the same way so that callers do
+// not need to know which storage scheme is in effect.
+type BackendConstructor func(CRDBackendConfiguration) (allocator.Backend, error)
+
+var (
+	backendsMutex lock.RWMutex
+	backends      = map[string]BackendConstructor{}
+)
+
+// RegisterBackend makes a named identity backend available to NewBackend.
+// It is expected to be called from the init() of the file defining the
+// backend.
+func RegisterBackend(name string, ctor BackendConstructor) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	backends[name] = ctor
+}
+
+// NewBackend constructs the identity backend registered under name. The
+// "crd" backend (one CiliumIdentity object per identity) is always
+// available; additional backends such as "crd-slice" trade per-identity
+// objects for coarser-grained storage at higher scale.
+func NewBackend(name string, c CRDBackendConfiguration) (allocator.Backend, error) {
+	backendsMutex.RLock()
+	ctor, ok := backends[name]
+	backendsMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown identity allocator backend %q", name)
+	}
+	return ctor(c)
+}
+
+func init() {
+	RegisterBackend("crd", NewCRDBackend)
+}
@@ -0,0 +1,725 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identitybackend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/cilium/cilium/pkg/allocator"
+	"github.com/cilium/cilium/pkg/idpool"
+	clientset "github.com/cilium/cilium/pkg/k8s/client/clientset/versioned"
+	"github.com/cilium/cilium/pkg/k8s/informer"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sTypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// sliceBackendName is the name the slice-based backend registers
+	// itself under; select it by passing this name to NewBackend.
+	sliceBackendName = "crd-slice"
+
+	// defaultSliceShards is the number of CiliumIdentitySlice objects
+	// identities are sharded across when NumShards is left unset. This
+	// keeps any single slice object from growing unbounded while still
+	// cutting the apiserver object count by orders of magnitude compared
+	// to one CiliumIdentity per identity.
+	defaultSliceShards = 64
+
+	sliceResourcePlural = "ciliumidentityslices"
+)
+
+var sliceGVR = schema.GroupVersionResource{
+	Group:    "cilium.io",
+	Version:  "v2",
+	Resource: sliceResourcePlural,
+}
+
+func init() {
+	RegisterBackend(sliceBackendName, func(c CRDBackendConfiguration) (allocator.Backend, error) {
+		return NewCiliumIdentitySliceBackend(SliceBackendConfiguration{
+			NodeName:                 c.NodeName,
+			Client:                   c.Client,
+			KeyType:                  c.KeyType,
+			NodesStore:               c.NodesStore,
+			IsLeader:                 c.IsLeader,
+			GCInterval:               c.GCInterval,
+			IdentityHeartbeatTimeout: c.IdentityHeartbeatTimeout,
+			GCDryRun:                 c.GCDryRun,
+		})
+	})
+}
+
+// CiliumIdentitySliceItem holds the identity information that used to live
+// in its own CiliumIdentity object.
+type CiliumIdentitySliceItem struct {
+	ID             string                 `json:"id"`
+	Labels         map[string]string      `json:"labels,omitempty"`
+	SecurityLabels map[string]string      `json:"securityLabels,omitempty"`
+	Nodes          map[string]metav1.Time `json:"nodes,omitempty"`
+}
+
+// CiliumIdentitySlice groups many identities' node references into a single
+// CRD object, the same way CiliumEndpointSlice groups CiliumEndpoints.
+type CiliumIdentitySlice struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Items             []CiliumIdentitySliceItem `json:"items"`
+}
+
+// GetObjectKind implements runtime.Object.
+func (in *CiliumIdentitySlice) GetObjectKind() schema.ObjectKind {
+	return &in.TypeMeta
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *CiliumIdentitySlice) DeepCopyObject() runtime.Object {
+	out := &CiliumIdentitySlice{TypeMeta: in.TypeMeta, ObjectMeta: *in.ObjectMeta.DeepCopy()}
+	if in.Items != nil {
+		out.Items = make([]CiliumIdentitySliceItem, len(in.Items))
+		for i, item := range in.Items {
+			out.Items[i] = item.deepCopy()
+		}
+	}
+	return out
+}
+
+func (in *CiliumIdentitySliceItem) deepCopy() CiliumIdentitySliceItem {
+	out := CiliumIdentitySliceItem{ID: in.ID}
+	if in.Labels != nil {
+		out.Labels = make(map[string]string, len(in.Labels))
+		for k, v := range in.Labels {
+			out.Labels[k] = v
+		}
+	}
+	if in.SecurityLabels != nil {
+		out.SecurityLabels = make(map[string]string, len(in.SecurityLabels))
+		for k, v := range in.SecurityLabels {
+			out.SecurityLabels[k] = v
+		}
+	}
+	if in.Nodes != nil {
+		out.Nodes = make(map[string]metav1.Time, len(in.Nodes))
+		for k, v := range in.Nodes {
+			out.Nodes[k] = v
+		}
+	}
+	return out
+}
+
+// CiliumIdentitySliceList is the list type client-go's generic ListWatch
+// machinery needs to decode "list" responses for CiliumIdentitySlice.
+type CiliumIdentitySliceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CiliumIdentitySlice `json:"items"`
+}
+
+// GetObjectKind implements runtime.Object.
+func (in *CiliumIdentitySliceList) GetObjectKind() schema.ObjectKind {
+	return &in.TypeMeta
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *CiliumIdentitySliceList) DeepCopyObject() runtime.Object {
+	out := &CiliumIdentitySliceList{TypeMeta: in.TypeMeta, ListMeta: *in.ListMeta.DeepCopy()}
+	if in.Items != nil {
+		out.Items = make([]CiliumIdentitySlice, len(in.Items))
+		for i, item := range in.Items {
+			out.Items[i] = *item.DeepCopyObject().(*CiliumIdentitySlice)
+		}
+	}
+	return out
+}
+
+// SliceBackendConfiguration configures the crd-slice identity backend.
+type SliceBackendConfiguration struct {
+	NodeName string
+	Client   clientset.Interface
+	KeyType  allocator.AllocatorKey
+
+	// NumShards controls how many CiliumIdentitySlice objects identities
+	// are distributed across. Defaults to defaultSliceShards when zero.
+	NumShards int
+
+	// NodesStore is the local cache of the cluster's live v1.Node objects,
+	// the slice-backend equivalent of crdBackend.NodesStore. RunGC
+	// cross-references it against each item's Nodes map to find stale
+	// node references; if nil, RunGC only considers items whose Nodes
+	// map is already empty.
+	NodesStore cache.Store
+
+	// IsLeader reports whether this process currently holds the
+	// operator's leader-election lock. RunGC is a no-op when it returns
+	// false. A nil IsLeader is treated as "always leader", for backends
+	// constructed outside the operator (e.g. in tests).
+	IsLeader func() bool
+
+	// GCInterval is the expected spacing between calls to RunGC, used to
+	// translate IdentityHeartbeatTimeout into a number of rounds an item
+	// must be observed empty before it is deleted. Defaults to
+	// defaultIdentityGCInterval when zero.
+	GCInterval time.Duration
+
+	// IdentityHeartbeatTimeout is the grace period an item with an empty
+	// (or fully stale) Nodes map is kept around before being deleted.
+	// Defaults to defaultIdentityHeartbeatTimeout when zero.
+	IdentityHeartbeatTimeout time.Duration
+
+	// GCDryRun, when true, logs the deletions and node-reference removals
+	// RunGC would have performed without issuing them.
+	GCDryRun bool
+}
+
+// shardName returns the stable CiliumIdentitySlice object name identity id
+// is sharded into: a hash of the identity ID modulo NumShards.
+func shardName(id idpool.ID, numShards int) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d", uint64(id))
+	return fmt.Sprintf("cid-slice-%d", h.Sum32()%uint32(numShards))
+}
+
+type sliceBackend struct {
+	SliceBackendConfiguration
+	store cache.Store
+}
+
+// NewCiliumIdentitySliceBackend creates an allocator.Backend that stores
+// identity->node references in a small number of CiliumIdentitySlice
+// objects rather than one CiliumIdentity per identity.
+func NewCiliumIdentitySliceBackend(c SliceBackendConfiguration) (allocator.Backend, error) {
+	if c.NumShards <= 0 {
+		c.NumShards = defaultSliceShards
+	}
+	return &sliceBackend{SliceBackendConfiguration: c}, nil
+}
+
+func (s *sliceBackend) DeleteAllKeys() {
+}
+
+func (s *sliceBackend) restClient() rest.Interface {
+	return s.Client.CiliumV2().RESTClient()
+}
+
+func (s *sliceBackend) getSlice(ctx context.Context, name string) (*CiliumIdentitySlice, error) {
+	if s.store != nil {
+		if obj, exists, err := s.store.GetByKey(name); err == nil && exists {
+			if slice, ok := obj.(*CiliumIdentitySlice); ok {
+				return slice, nil
+			}
+		}
+	}
+
+	result := &CiliumIdentitySlice{}
+	err := s.restClient().Get().Context(ctx).Resource(sliceResourcePlural).Name(name).Do().Into(result)
+	return result, err
+}
+
+// AllocateID appends a new item to the identity's shard, creating the shard
+// object on first use.
+func (s *sliceBackend) AllocateID(ctx context.Context, id idpool.ID, key allocator.AllocatorKey) error {
+	name := shardName(id, s.NumShards)
+	selectedLabels, skippedLabels := sanitizeK8sLabels(key.GetAsMap())
+	log.WithField(logfields.Labels, skippedLabels).Debug("Skipped non-kubernetes labels when labelling ciliumidentityslice item")
+
+	item := CiliumIdentitySliceItem{
+		ID:             id.String(),
+		Labels:         selectedLabels,
+		SecurityLabels: key.GetAsMap(),
+		Nodes:          map[string]metav1.Time{s.NodeName: metav1.Now()},
+	}
+
+	patch, err := json.Marshal([]JSONPatch{{OP: "add", Path: "/items/-", Value: item}})
+	if err != nil {
+		return err
+	}
+
+	err = s.restClient().Patch(k8sTypes.JSONPatchType).Context(ctx).
+		Resource(sliceResourcePlural).Name(name).Body(patch).Do().Error()
+	if err == nil {
+		return nil
+	}
+
+	// The shard object does not exist yet: create it with this item as
+	// its sole entry.
+	slice := &CiliumIdentitySlice{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Items:      []CiliumIdentitySliceItem{item},
+	}
+	return s.restClient().Post().Context(ctx).Resource(sliceResourcePlural).Body(slice).Do().Error()
+}
+
+func (s *sliceBackend) AllocateIDIfLocked(ctx context.Context, id idpool.ID, key allocator.AllocatorKey, lock kvstore.KVLocker) error {
+	return s.AllocateID(ctx, id, key)
+}
+
+func (s *sliceBackend) findItemIndex(slice *CiliumIdentitySlice, id idpool.ID) int {
+	target := id.String()
+	for i := range slice.Items {
+		if slice.Items[i].ID == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// mutateNode patches the /items/{index}/nodes/{node} field of the shard
+// holding id, the slice-backend equivalent of crdBackend's per-identity
+// status patch. The patch is guarded by a "test" of the item's id at that
+// index, the same way deleteItemIfStillEmpty is, so that a concurrent
+// RunGC deletion (which shifts every later index down by one) makes this
+// patch fail instead of silently landing on the wrong identity's item.
+func (s *sliceBackend) mutateNode(ctx context.Context, id idpool.ID, op string, value interface{}) error {
+	name := shardName(id, s.NumShards)
+	slice, err := s.getSlice(ctx, name)
+	if err != nil {
+		return fmt.Errorf("identity slice %q does not exist: %w", name, err)
+	}
+
+	index := s.findItemIndex(slice, id)
+	if index < 0 {
+		return fmt.Errorf("identity %s not found in slice %q", id, name)
+	}
+
+	nodePath := fmt.Sprintf("/items/%d/nodes/%s", index, s.NodeName)
+	patch, err := json.Marshal([]JSONPatch{
+		{OP: "test", Path: fmt.Sprintf("/items/%d/id", index), Value: id.String()},
+		{OP: op, Path: nodePath, Value: value},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.restClient().Patch(k8sTypes.JSONPatchType).Context(ctx).
+		Resource(sliceResourcePlural).Name(name).Body(patch).Do().Error()
+}
+
+// AcquireReference marks this node as using id by writing its name and a
+// timestamp into the owning shard's item. The patch uses "add" rather than
+// "replace": per RFC 6902, "add" upserts an object member, while "replace"
+// requires the member to already exist, which isn't true the first time a
+// node other than the one that created the item acquires a reference to it.
+func (s *sliceBackend) AcquireReference(ctx context.Context, id idpool.ID, key allocator.AllocatorKey, lock kvstore.KVLocker) error {
+	return s.mutateNode(ctx, id, "add", metav1.Now())
+}
+
+// Release removes this node's reference from the owning shard's item, after
+// checking that this node actually holds one, mirroring
+// crdBackend.Release.
+func (s *sliceBackend) Release(ctx context.Context, key allocator.AllocatorKey) error {
+	id, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if id == idpool.NoID {
+		return fmt.Errorf("unable to release identity %s: identity does not exist", key)
+	}
+
+	name := shardName(id, s.NumShards)
+	slice, err := s.getSlice(ctx, name)
+	if err != nil {
+		return fmt.Errorf("identity slice %q does not exist: %w", name, err)
+	}
+	index := s.findItemIndex(slice, id)
+	if index < 0 {
+		return fmt.Errorf("identity %s not found in slice %q", id, name)
+	}
+	if _, ok := slice.Items[index].Nodes[s.NodeName]; !ok {
+		return fmt.Errorf("unable to release identity %s: identity is unused", key)
+	}
+
+	return s.mutateNode(ctx, id, "delete", nil)
+}
+
+// RunGC removes stale node references and orphaned items from every
+// CiliumIdentitySlice, the slice-backend equivalent of crdBackend.RunGC.
+// staleKeysPrevRound counts, keyed by identity ID, how many consecutive
+// rounds each item has been observed with an empty (or fully stale) Nodes
+// map, and is threaded back in on the next call so the grace period
+// survives across invocations without needing its own timer.
+func (s *sliceBackend) RunGC(ctx context.Context, staleKeysPrevRound map[string]uint64) (map[string]uint64, error) {
+	if s.IsLeader != nil && !s.IsLeader() {
+		return staleKeysPrevRound, nil
+	}
+	if s.store == nil {
+		return staleKeysPrevRound, nil
+	}
+
+	liveNodes := s.liveNodeSet()
+	graceRounds := s.gcGraceRounds()
+
+	next := map[string]uint64{}
+	for _, obj := range s.store.List() {
+		slice, ok := obj.(*CiliumIdentitySlice)
+		if !ok {
+			continue
+		}
+		for _, item := range slice.Items {
+			identitiesScanned.Inc()
+
+			empty, err := s.pruneStaleNodes(ctx, slice.GetName(), item, liveNodes)
+			if err != nil {
+				log.WithError(err).WithField(logfields.Identity, item.ID).
+					Warning("Unable to remove stale node references from CiliumIdentitySlice item")
+				identitiesSkipped.Inc()
+				next[item.ID] = staleKeysPrevRound[item.ID]
+				continue
+			}
+			if !empty {
+				continue
+			}
+
+			rounds := staleKeysPrevRound[item.ID] + 1
+			if rounds <= graceRounds {
+				next[item.ID] = rounds
+				continue
+			}
+
+			if s.GCDryRun {
+				log.WithField(logfields.Identity, item.ID).
+					Info("Would delete orphaned CiliumIdentitySlice item (dry-run)")
+				continue
+			}
+
+			if err := s.deleteItemIfStillEmpty(ctx, slice.GetName(), item.ID); err != nil {
+				log.WithError(err).WithField(logfields.Identity, item.ID).
+					Debug("Unable to delete orphaned CiliumIdentitySlice item, will retry next round")
+				identitiesSkipped.Inc()
+				next[item.ID] = rounds
+				continue
+			}
+
+			identitiesRemoved.Inc()
+		}
+	}
+
+	return next, nil
+}
+
+// gcGraceRounds converts IdentityHeartbeatTimeout into a number of RunGC
+// invocations using GCInterval as the expected spacing between them.
+func (s *sliceBackend) gcGraceRounds() uint64 {
+	interval := s.GCInterval
+	if interval <= 0 {
+		interval = defaultIdentityGCInterval
+	}
+	timeout := s.IdentityHeartbeatTimeout
+	if timeout <= 0 {
+		timeout = defaultIdentityHeartbeatTimeout
+	}
+	if rounds := uint64(timeout / interval); rounds > 0 {
+		return rounds
+	}
+	return 1
+}
+
+// liveNodeSet returns the set of node names currently known to exist, or
+// nil if no node informer cache was configured.
+func (s *sliceBackend) liveNodeSet() map[string]struct{} {
+	if s.NodesStore == nil {
+		return nil
+	}
+	live := make(map[string]struct{})
+	for _, obj := range s.NodesStore.List() {
+		if node, ok := obj.(*v1.Node); ok {
+			live[node.GetName()] = struct{}{}
+		}
+	}
+	return live
+}
+
+// pruneStaleNodes removes item's Nodes entries that reference nodes not
+// present in liveNodes (a nil liveNodes leaves Nodes untouched), and reports
+// whether item's Nodes map is now empty. The patch is guarded by a "test" of
+// the item's id at the resolved index, the same way deleteItemIfStillEmpty
+// is, so a concurrent deletion earlier in the same shard (which shifts every
+// later index down by one) makes this patch fail instead of silently
+// pruning nodes from the wrong identity's item.
+func (s *sliceBackend) pruneStaleNodes(ctx context.Context, sliceName string, item CiliumIdentitySliceItem, liveNodes map[string]struct{}) (empty bool, err error) {
+	if len(item.Nodes) == 0 {
+		return true, nil
+	}
+	if liveNodes == nil {
+		return false, nil
+	}
+
+	var stale []string
+	for node := range item.Nodes {
+		if _, alive := liveNodes[node]; !alive {
+			stale = append(stale, node)
+		}
+	}
+	if len(stale) == 0 {
+		return false, nil
+	}
+
+	if s.GCDryRun {
+		log.WithField(logfields.Identity, item.ID).WithField("staleNodes", stale).
+			Info("Would remove stale node references from CiliumIdentitySlice item (dry-run)")
+		return len(stale) == len(item.Nodes), nil
+	}
+
+	id, err := strconv.ParseUint(item.ID, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid identity ID %q in slice %q: %w", item.ID, sliceName, err)
+	}
+
+	slice, err := s.getSlice(ctx, sliceName)
+	if err != nil {
+		return false, err
+	}
+	index := s.findItemIndex(slice, idpool.ID(id))
+	if index < 0 {
+		// Item is gone already; nothing left to prune.
+		return false, nil
+	}
+
+	ops := make([]JSONPatch, 0, len(stale)+1)
+	ops = append(ops, JSONPatch{OP: "test", Path: fmt.Sprintf("/items/%d/id", index), Value: item.ID})
+	for _, node := range stale {
+		ops = append(ops, JSONPatch{OP: "remove", Path: fmt.Sprintf("/items/%d/nodes/%s", index, node)})
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return false, err
+	}
+	err = s.restClient().Patch(k8sTypes.JSONPatchType).Context(ctx).
+		Resource(sliceResourcePlural).Name(sliceName).Body(patch).Do().Error()
+	if err != nil {
+		return false, err
+	}
+
+	identityNodesRemoved.Add(float64(len(stale)))
+	return len(stale) == len(item.Nodes), nil
+}
+
+// deleteItemIfStillEmpty removes id's item from its shard if its Nodes map is
+// still empty, guarded by tests of the shard's resourceVersion and of the
+// item's id so that a concurrent AcquireReference landing between our scan
+// and this delete aborts instead of racing it (TOCTOU), the slice-backend
+// equivalent of crdBackend.deleteIfStillEmpty.
+func (s *sliceBackend) deleteItemIfStillEmpty(ctx context.Context, sliceName string, itemID string) error {
+	slice, err := s.getSlice(ctx, sliceName)
+	if err != nil {
+		return err
+	}
+	parsed, err := strconv.ParseUint(itemID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid identity ID %q in slice %q: %w", itemID, sliceName, err)
+	}
+	index := s.findItemIndex(slice, idpool.ID(parsed))
+	if index < 0 {
+		return nil
+	}
+	if len(slice.Items[index].Nodes) > 0 {
+		return fmt.Errorf("identity %s in slice %q is referenced again", itemID, sliceName)
+	}
+
+	patch, err := json.Marshal([]JSONPatch{
+		{OP: "test", Path: "/metadata/resourceVersion", Value: slice.ResourceVersion},
+		{OP: "test", Path: fmt.Sprintf("/items/%d/id", index), Value: itemID},
+		{OP: "remove", Path: fmt.Sprintf("/items/%d", index)},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.restClient().Patch(k8sTypes.JSONPatchType).Context(ctx).
+		Resource(sliceResourcePlural).Name(sliceName).Body(patch).Do().Error()
+}
+
+func (s *sliceBackend) UpdateKey(ctx context.Context, id idpool.ID, key allocator.AllocatorKey, reliablyMissing bool) error {
+	if err := s.AcquireReference(ctx, id, key, nil); err == nil {
+		return nil
+	}
+	if reliablyMissing {
+		return s.AllocateID(ctx, id, key)
+	}
+	return nil
+}
+
+func (s *sliceBackend) UpdateKeyIfLocked(ctx context.Context, id idpool.ID, key allocator.AllocatorKey, reliablyMissing bool, lock kvstore.KVLocker) error {
+	return s.UpdateKey(ctx, id, key, reliablyMissing)
+}
+
+func (s *sliceBackend) Lock(ctx context.Context, key allocator.AllocatorKey) (kvstore.KVLocker, error) {
+	return &crdLock{}, nil
+}
+
+func (s *sliceBackend) findByLabels(key allocator.AllocatorKey) (idpool.ID, bool) {
+	if s.store == nil {
+		return idpool.NoID, false
+	}
+	for _, obj := range s.store.List() {
+		slice, ok := obj.(*CiliumIdentitySlice)
+		if !ok {
+			continue
+		}
+		for _, item := range slice.Items {
+			if reflect.DeepEqual(item.SecurityLabels, key.GetAsMap()) {
+				id, err := strconv.ParseUint(item.ID, 10, 64)
+				if err != nil {
+					continue
+				}
+				return idpool.ID(id), true
+			}
+		}
+	}
+	return idpool.NoID, false
+}
+
+// Get returns the ID allocated to key, scanning every shard in the local
+// store.
+func (s *sliceBackend) Get(ctx context.Context, key allocator.AllocatorKey) (idpool.ID, error) {
+	id, _ := s.findByLabels(key)
+	return id, nil
+}
+
+func (s *sliceBackend) GetIfLocked(ctx context.Context, key allocator.AllocatorKey, lock kvstore.KVLocker) (idpool.ID, error) {
+	return s.Get(ctx, key)
+}
+
+// GetByID returns the key associated with id by locating its item within
+// the local store, without needing to know which shard it lives in.
+func (s *sliceBackend) GetByID(ctx context.Context, id idpool.ID) (allocator.AllocatorKey, error) {
+	if s.store == nil {
+		return nil, fmt.Errorf("store is not available yet")
+	}
+
+	target := id.String()
+	for _, obj := range s.store.List() {
+		slice, ok := obj.(*CiliumIdentitySlice)
+		if !ok {
+			continue
+		}
+		for _, item := range slice.Items {
+			if item.ID == target {
+				return s.KeyType.PutKeyFromMap(item.SecurityLabels), nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// ListAndWatch fans out CiliumIdentitySlice add/update/delete events to
+// per-identity OnAdd/OnModify/OnDelete callbacks, diffing each shard's item
+// list against its previous version, so existing allocator.CacheMutations
+// consumers do not need to know slices exist.
+func (s *sliceBackend) ListAndWatch(handler allocator.CacheMutations, stopChan chan struct{}) {
+	s.store = cache.NewStore(cache.DeletionHandlingMetaNamespaceKeyFunc)
+
+	itemsByID := func(slice *CiliumIdentitySlice) map[string]CiliumIdentitySliceItem {
+		m := make(map[string]CiliumIdentitySliceItem, len(slice.Items))
+		for _, item := range slice.Items {
+			m[item.ID] = item
+		}
+		return m
+	}
+
+	sliceInformer := informer.NewInformerWithStore(
+		cache.NewListWatchFromClient(s.restClient(), sliceResourcePlural, "", fields.Everything()),
+		&CiliumIdentitySlice{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				slice, ok := obj.(*CiliumIdentitySlice)
+				if !ok {
+					return
+				}
+				for id, item := range itemsByID(slice) {
+					if parsedID, err := strconv.ParseUint(id, 10, 64); err == nil {
+						handler.OnAdd(idpool.ID(parsedID), s.KeyType.PutKeyFromMap(item.SecurityLabels))
+					}
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldSlice, ok := oldObj.(*CiliumIdentitySlice)
+				if !ok {
+					return
+				}
+				newSlice, ok := newObj.(*CiliumIdentitySlice)
+				if !ok {
+					return
+				}
+				oldItems := itemsByID(oldSlice)
+				newItems := itemsByID(newSlice)
+				for id, item := range newItems {
+					parsedID, err := strconv.ParseUint(id, 10, 64)
+					if err != nil {
+						continue
+					}
+					if _, existed := oldItems[id]; existed {
+						handler.OnModify(idpool.ID(parsedID), s.KeyType.PutKeyFromMap(item.SecurityLabels))
+					} else {
+						handler.OnAdd(idpool.ID(parsedID), s.KeyType.PutKeyFromMap(item.SecurityLabels))
+					}
+				}
+				for id, item := range oldItems {
+					if _, stillPresent := newItems[id]; !stillPresent {
+						if parsedID, err := strconv.ParseUint(id, 10, 64); err == nil {
+							handler.OnDelete(idpool.ID(parsedID), s.KeyType.PutKeyFromMap(item.SecurityLabels))
+						}
+					}
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if deleteObj, isDeleteObj := obj.(cache.DeletedFinalStateUnknown); isDeleteObj {
+					obj = deleteObj.Obj
+				}
+				slice, ok := obj.(*CiliumIdentitySlice)
+				if !ok {
+					return
+				}
+				for id, item := range itemsByID(slice) {
+					if parsedID, err := strconv.ParseUint(id, 10, 64); err == nil {
+						handler.OnDelete(idpool.ID(parsedID), s.KeyType.PutKeyFromMap(item.SecurityLabels))
+					}
+				}
+			},
+		},
+		func(obj interface{}) (interface{}, error) { return obj, nil },
+		s.store,
+	)
+
+	go func() {
+		if ok := cache.WaitForCacheSync(stopChan, sliceInformer.HasSynced); ok {
+			handler.OnListDone()
+		}
+	}()
+
+	sliceInformer.Run(stopChan)
+}
+
+func (s *sliceBackend) Status() (string, error) {
+	return "OK", nil
+}
+
+func (s *sliceBackend) Encode(v string) string {
+	return v
+}
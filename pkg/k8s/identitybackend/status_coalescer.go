@@ -0,0 +1,346 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identitybackend
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sTypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// defaultCoalesceInterval is how often an identity with pending
+	// mutations is requeued if nothing else triggers a flush sooner.
+	defaultCoalesceInterval = 10 * time.Second
+
+	// defaultCoalesceThreshold is the number of identities with pending
+	// mutations that triggers an immediate flush of the whole buffer
+	// instead of waiting for defaultCoalesceInterval to elapse.
+	defaultCoalesceThreshold = 128
+
+	nodeMutationAdd    = "add"
+	nodeMutationDelete = "delete"
+)
+
+var (
+	identityStatusWritesCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity",
+		Name:      "status_writes_coalesced_total",
+		Help:      "Number of node reference mutations merged into an already-pending CiliumIdentity status write",
+	})
+	identityStatusWritesIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "identity",
+		Name:      "status_writes_issued_total",
+		Help:      "Number of CiliumIdentity status writes issued to the apiserver",
+	})
+)
+
+func init() {
+	metrics.MustRegister(identityStatusWritesCoalesced, identityStatusWritesIssued)
+}
+
+// nodeMutation describes a single pending change to a CiliumIdentity's
+// Status.Nodes map for one node.
+type nodeMutation struct {
+	op string
+	ts metav1.Time
+}
+
+// identityOpsInterface is the subset of the CiliumIdentity client used by
+// the coalescer. It exists so that tests can substitute a fake without
+// pulling in the full generated clientset.
+type identityOpsInterface interface {
+	Patch(name string, pt k8sTypes.PatchType, data []byte, subresources ...string) (*v2.CiliumIdentity, error)
+}
+
+// statusCoalescer buffers per-identity CiliumIdentity status mutations
+// (AcquireReference / Release) in memory and flushes them as a single
+// merged JSONPatch per identity, rather than issuing one apiserver call per
+// mutation. This keeps apiserver churn bounded when a node is managing
+// thousands of endpoints that reference a shared set of identities.
+//
+// Pending mutations are tracked in a plain map keyed by identity name, and
+// the identity name is also pushed onto a rate-limiting work queue. The
+// queue gives us de-duplication for free (re-adding an identity that is
+// already queued is a no-op) and exponential backoff on repeated apiserver
+// rejections, without multiplying the number of pending writes.
+type statusCoalescer struct {
+	identityOps identityOpsInterface
+
+	interval  time.Duration
+	threshold int
+
+	mutex   lock.Mutex
+	pending map[string]map[string]nodeMutation // identity name -> node name -> mutation
+
+	queue workqueue.RateLimitingInterface
+
+	stopOnce sync.Once
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newStatusCoalescer(identityOps identityOpsInterface, interval time.Duration, threshold int) *statusCoalescer {
+	if interval <= 0 {
+		interval = defaultCoalesceInterval
+	}
+	if threshold <= 0 {
+		threshold = defaultCoalesceThreshold
+	}
+
+	return &statusCoalescer{
+		identityOps: identityOps,
+		interval:    interval,
+		threshold:   threshold,
+		pending:     map[string]map[string]nodeMutation{},
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		stopChan:    make(chan struct{}),
+	}
+}
+
+// Run starts the single worker that drains the queue, plus the periodic
+// requeue loop that bounds how long a mutation can sit unflushed. It blocks
+// until Stop is called.
+func (s *statusCoalescer) Run() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for s.processNextItem() {
+		}
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopChan:
+			s.queue.ShutDown()
+			s.wg.Wait()
+			return
+		case <-ticker.C:
+			s.requeueAllPending()
+		}
+	}
+}
+
+// Stop flushes any pending mutations using ctx (so shutdown can bound how
+// long it waits on the apiserver), then shuts the worker down.
+func (s *statusCoalescer) Stop(ctx context.Context) {
+	s.Flush(ctx)
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+}
+
+// queueMutation records a pending node reference mutation for identityName,
+// replacing any mutation already pending for the same node. The identity is
+// queued for a flush on the next tick of the coalescing interval; if the
+// number of distinct identities with pending mutations reaches the
+// configured threshold, every pending identity is queued immediately
+// instead.
+func (s *statusCoalescer) queueMutation(identityName, nodeName, op string) {
+	s.mutex.Lock()
+	identityPending, ok := s.pending[identityName]
+	if !ok {
+		identityPending = map[string]nodeMutation{}
+		s.pending[identityName] = identityPending
+	} else {
+		identityStatusWritesCoalesced.Inc()
+	}
+	identityPending[nodeName] = nodeMutation{op: op, ts: metav1.Now()}
+	pendingCount := len(s.pending)
+	s.mutex.Unlock()
+
+	if pendingCount >= s.threshold {
+		s.requeueAllPending()
+	}
+}
+
+func (s *statusCoalescer) requeueAllPending() {
+	s.mutex.Lock()
+	names := make([]string, 0, len(s.pending))
+	for name := range s.pending {
+		names = append(names, name)
+	}
+	s.mutex.Unlock()
+
+	for _, name := range names {
+		s.queue.Add(name)
+	}
+}
+
+// Flush synchronously writes out all pending mutations. It is used by tests
+// and during graceful shutdown where callers need a guarantee that buffered
+// mutations have reached the apiserver before proceeding.
+func (s *statusCoalescer) Flush(ctx context.Context) error {
+	s.mutex.Lock()
+	batch := s.pending
+	s.pending = map[string]map[string]nodeMutation{}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for identityName, mutations := range batch {
+		s.queue.Forget(identityName)
+		if err := s.flushIdentity(ctx, identityName, mutations); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// processNextItem pops a single identity name off the queue and flushes
+// whatever mutations are currently pending for it. It returns false once
+// the queue has been shut down.
+func (s *statusCoalescer) processNextItem() bool {
+	key, shutdown := s.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer s.queue.Done(key)
+
+	identityName := key.(string)
+
+	s.mutex.Lock()
+	mutations := s.pending[identityName]
+	delete(s.pending, identityName)
+	s.mutex.Unlock()
+
+	if len(mutations) == 0 {
+		s.queue.Forget(key)
+		return true
+	}
+
+	if err := s.flushIdentity(context.Background(), identityName, mutations); err != nil {
+		log.WithError(err).WithField(logfields.Identity, identityName).
+			Warning("Unable to flush coalesced CiliumIdentity status, will retry")
+		s.requeueMutations(identityName, mutations)
+		s.queue.AddRateLimited(key)
+		return true
+	}
+
+	s.queue.Forget(key)
+	return true
+}
+
+// requeueMutations re-merges mutations back into the pending buffer without
+// clobbering anything newer that arrived while the flush was in flight.
+func (s *statusCoalescer) requeueMutations(identityName string, mutations map[string]nodeMutation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	identityPending, ok := s.pending[identityName]
+	if !ok {
+		s.pending[identityName] = mutations
+		return
+	}
+	for node, mutation := range mutations {
+		if _, newer := identityPending[node]; !newer {
+			identityPending[node] = mutation
+		}
+	}
+}
+
+// flushIdentity merges all pending mutations for a single identity into one
+// JSONPatch, with "add" operations before "delete" operations. Each node has
+// at most one pending mutation (the latest), so a node which was both
+// acquired and released within the same coalescing window ends up in the
+// state of its last mutation. If the merged patch is rejected by the
+// apiserver, it falls back to issuing one patch per mutation.
+func (s *statusCoalescer) flushIdentity(ctx context.Context, identityName string, mutations map[string]nodeMutation) error {
+	var adds, deletes []JSONPatch
+	for node, mutation := range mutations {
+		switch mutation.op {
+		case nodeMutationAdd:
+			// "add" on an existing object member upserts (replaces) its
+			// value per RFC 6902; "replace" would instead require the
+			// member to already exist, which isn't true for a node
+			// acquiring a reference to an identity it didn't create.
+			adds = append(adds, JSONPatch{
+				OP:    "add",
+				Path:  "/status/nodes/" + node,
+				Value: mutation.ts,
+			})
+		case nodeMutationDelete:
+			deletes = append(deletes, JSONPatch{
+				OP:   "delete",
+				Path: "/status/nodes/" + node,
+			})
+		}
+	}
+	ops := append(adds, deletes...)
+	if len(ops) == 0 {
+		return nil
+	}
+
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	// flushIdentity is only reached via AcquireReference/Release once
+	// capabilities.Patch has already been confirmed true (apiservers that
+	// don't support Patch use acquireReferenceLegacy/releaseLegacy
+	// instead), so a failure here can only be the merged patch itself
+	// being rejected, not a missing Patch capability.
+	err = withContext(ctx, func() error {
+		_, err := s.identityOps.Patch(identityName, k8sTypes.JSONPatchType, patch, "status")
+		return err
+	})
+	if err == nil {
+		identityStatusWritesIssued.Inc()
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	log.WithError(err).WithField(logfields.Identity, identityName).
+		Debug("Coalesced status patch rejected, falling back to per-mutation writes")
+
+	var firstErr error
+	for _, op := range ops {
+		patch, err := json.Marshal([]JSONPatch{op})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		err = withContext(ctx, func() error {
+			_, err := s.identityOps.Patch(identityName, k8sTypes.JSONPatchType, patch, "status")
+			return err
+		})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		identityStatusWritesIssued.Inc()
+	}
+	return firstErr
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identitybackend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2"
+
+	k8sTypes "k8s.io/apimachinery/pkg/types"
+)
+
+// blockingIdentityOps is a fake identityOpsInterface whose Patch call hangs
+// until unblock is closed, standing in for an apiserver reactor that never
+// responds (e.g. a partitioned apiserver) so that withContext's cancellation
+// path can be exercised without a real clientset.
+type blockingIdentityOps struct {
+	unblock chan struct{}
+	calls   chan struct{}
+}
+
+func newBlockingIdentityOps() *blockingIdentityOps {
+	return &blockingIdentityOps{
+		unblock: make(chan struct{}),
+		calls:   make(chan struct{}, 1),
+	}
+}
+
+func (b *blockingIdentityOps) Patch(name string, pt k8sTypes.PatchType, data []byte, subresources ...string) (*v2.CiliumIdentity, error) {
+	select {
+	case b.calls <- struct{}{}:
+	default:
+	}
+	<-b.unblock
+	return &v2.CiliumIdentity{}, nil
+}
+
+func TestStatusCoalescerFlushReturnsOnContextCancel(t *testing.T) {
+	ops := newBlockingIdentityOps()
+	s := newStatusCoalescer(ops, time.Minute, defaultCoalesceThreshold)
+	s.queueMutation("identity-1", "node-1", nodeMutationAdd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- s.Flush(ctx) }()
+
+	select {
+	case <-ops.calls:
+	case <-time.After(time.Second):
+		t.Fatal("Patch was never called")
+	}
+
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Flush did not return after context cancellation")
+	}
+}
+
+func TestWithContextReturnsOnCancelWhileFnBlocks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- withContext(ctx, func() error {
+			close(started)
+			select {}
+		})
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("withContext did not return after context cancellation")
+	}
+}